@@ -0,0 +1,112 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gossip
+
+import (
+	"sync"
+	"time"
+)
+
+// reconciliationInterval returns how often the anti-entropy loop should wake up and pick a peer
+// to reconcile with, for the mode conf selects. A PushOnly round is paced by PushInterval when
+// the caller set one; every other mode is paced by PullInterval, since a PushPull round begins
+// with a pull.
+func reconciliationInterval(conf *Config) time.Duration {
+	if conf.ReconciliationMode == PushOnly && conf.PushInterval > 0 {
+		return conf.PushInterval
+	}
+	return conf.PullInterval
+}
+
+// reconciliationFanout returns how many peers a single anti-entropy round should contact for the
+// mode conf selects, preferring the per-mode peer count and falling back to PullPeerNum.
+func reconciliationFanout(conf *Config) int {
+	if conf.ReconciliationMode == PushOnly && conf.PushPeerNum > 0 {
+		return conf.PushPeerNum
+	}
+	return conf.PullPeerNum
+}
+
+// reconcile performs one anti-entropy round with peer, dispatching to the push, pull, or
+// push-pull exchange selected by conf.ReconciliationMode. It is invoked once per peer, per tick,
+// by the anti-entropy loop that already owns peer selection and the wire-level push/pull
+// protocol; this function only decides which of those operations to run for the configured mode.
+func reconcile(conf *Config, push, pull func()) {
+	switch conf.ReconciliationMode {
+	case PushOnly:
+		push()
+	case PushPull:
+		pull()
+		push()
+	default:
+		pull()
+	}
+}
+
+// AntiEntropy drives the periodic anti-entropy rounds for a Gossip instance: it wakes up every
+// reconciliationInterval, picks reconciliationFanout peers via peerSelector, and reconciles with
+// each of them using push, pull, or push-pull as selected by conf.ReconciliationMode. It owns its
+// own ticker and is started by its constructor, the same way GossipStateProvider owns its
+// background loops.
+type AntiEntropy struct {
+	conf         *Config
+	peerSelector func(n int) []string
+	push, pull   func(peer string)
+
+	stopCh chan struct{}
+	once   sync.Once
+}
+
+// NewAntiEntropy creates an AntiEntropy loop for conf and immediately starts it. peerSelector
+// returns up to n peers to reconcile with in a round; push and pull perform one reconciliation
+// exchange with a single peer, using whatever wire-level push/pull protocol the caller's
+// transport implements.
+func NewAntiEntropy(conf *Config, peerSelector func(n int) []string, push, pull func(peer string)) *AntiEntropy {
+	ae := &AntiEntropy{
+		conf:         conf,
+		peerSelector: peerSelector,
+		push:         push,
+		pull:         pull,
+		stopCh:       make(chan struct{}),
+	}
+	go ae.run()
+	return ae
+}
+
+func (ae *AntiEntropy) run() {
+	ticker := time.NewTicker(reconciliationInterval(ae.conf))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ae.stopCh:
+			return
+		case <-ticker.C:
+			for _, peer := range ae.peerSelector(reconciliationFanout(ae.conf)) {
+				peer := peer
+				reconcile(ae.conf, func() { ae.push(peer) }, func() { ae.pull(peer) })
+			}
+		}
+	}
+}
+
+// Stop terminates the anti-entropy loop.
+func (ae *AntiEntropy) Stop() {
+	ae.once.Do(func() {
+		close(ae.stopCh)
+	})
+}
@@ -0,0 +1,71 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gossip
+
+import "time"
+
+// ReconciliationMode selects which classical gossip anti-entropy operation a Gossip instance
+// uses to reconcile its local state with the rest of the network.
+type ReconciliationMode int
+
+const (
+	// PullOnly sends (key, version) digests to a randomly chosen peer and receives back whatever
+	// entries that peer has that are missing or newer locally. This is the mode Gossip has
+	// always used, and remains the zero value so that existing Config literals that only set
+	// PullInterval/PullPeerNum keep their current behavior.
+	PullOnly ReconciliationMode = iota
+
+	// PushOnly sends (key, value, version) to a randomly chosen peer, who updates its own copy
+	// if the pushed version is newer. Cheapest per round, but convergence depends on enough
+	// pushes reaching every peer over time — a good fit for low-churn networks, such as an
+	// ordering service's peer set.
+	PushOnly
+
+	// PushPull performs a PullOnly exchange and then reciprocates with a push of the entries the
+	// remote peer turned out to be missing, in the same round. Converges fastest of the
+	// three at the highest bandwidth cost per round — suited to organizations that add peers
+	// often and want them caught up quickly.
+	PushPull
+)
+
+// Config configures a Gossip instance.
+type Config struct {
+	BindPort                   int
+	BootstrapPeers             []string
+	ID                         string
+	MaxMessageCountToStore     int
+	MaxPropagationBurstLatency time.Duration
+	MaxPropagationBurstSize    int
+	PropagateIterations        int
+	PropagatePeerNum           int
+
+	// ReconciliationMode selects the anti-entropy strategy used to reconcile this peer's state
+	// with the network; see PullOnly, PushOnly and PushPull.
+	ReconciliationMode ReconciliationMode
+
+	// PushInterval and PushPeerNum configure PushOnly rounds. If unset, PushOnly falls back to
+	// PullInterval/PullPeerNum.
+	PushInterval time.Duration
+	PushPeerNum  int
+
+	// PullInterval and PullPeerNum configure PullOnly and PushPull rounds, and PushOnly rounds
+	// when PushInterval/PushPeerNum are unset.
+	PullInterval time.Duration
+	PullPeerNum  int
+
+	SelfEndpoint string
+}
@@ -19,6 +19,7 @@ package integration
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +27,7 @@ import (
 	"github.com/hyperledger/fabric/gossip/comm"
 	"github.com/hyperledger/fabric/gossip/gossip"
 	"github.com/hyperledger/fabric/gossip/proto"
+	"github.com/hyperledger/fabric/gossip/service"
 	"google.golang.org/grpc"
 	"github.com/hyperledger/fabric/gossip/api"
 	"github.com/hyperledger/fabric/gossip/common"
@@ -33,7 +35,7 @@ import (
 
 // This file is used to bootstrap a gossip instance for integration/demo purposes ONLY
 
-func newConfig(selfEndpoint string, bootPeers ...string) *gossip.Config {
+func newConfig(selfEndpoint string, mode gossip.ReconciliationMode, bootPeers ...string) *gossip.Config {
 	port, err := strconv.ParseInt(strings.Split(selfEndpoint, ":")[1], 10, 64)
 	if err != nil {
 		panic(err)
@@ -47,25 +49,84 @@ func newConfig(selfEndpoint string, bootPeers ...string) *gossip.Config {
 		MaxPropagationBurstSize:    3,
 		PropagateIterations:        1,
 		PropagatePeerNum:           3,
+		ReconciliationMode:         mode,
+		PushInterval:               time.Second * 5,
+		PushPeerNum:                3,
 		PullInterval:               time.Second * 5,
 		PullPeerNum:                3,
 		SelfEndpoint:               selfEndpoint,
 	}
 }
 
-func newComm(selfEndpoint string, s *grpc.Server, dialOpts ...grpc.DialOption) comm.Comm {
-	comm, err := comm.NewCommInstance(s, NewGossipCryptoService(), []byte(selfEndpoint), dialOpts...)
+func newComm(identity api.PeerIdentityType, s *grpc.Server, mcs CryptoService, secureConf *SecureConfig) comm.Comm {
+	dialOpts, err := secureConf.dialOptions()
+	if err != nil {
+		panic(err)
+	}
+
+	comm, err := comm.NewCommInstance(s, mcs, []byte(identity), dialOpts...)
 	if err != nil {
 		panic(err)
 	}
 	return comm
 }
 
-// NewGossipComponent creates a gossip component that attaches itself to the given gRPC server
-func NewGossipComponent(endpoint string, s *grpc.Server, bootPeers ...string) (gossip.Gossip, comm.Comm) {
-	conf := newConfig(endpoint, bootPeers...)
-	comm := newComm(endpoint, s, grpc.WithInsecure())
-	return gossip.NewGossipService(conf, comm, &naiveCryptoService{}, NewGossipCryptoService(), api.PeerIdentityType(conf.ID)), comm
+// NewGossipComponent creates a gossip component that attaches itself to the given gRPC server,
+// wrapped in a service.GossipService that replicates channel ledgers on top of the raw gossip
+// transport. identity is this peer's serialized identity (e.g. the bytes of
+// msp.SigningIdentity.Serialize() for the peer's local MSP); it is used both as this peer's
+// PKI-ID seed and as the security provider's credential, so it must already be whatever form mcs
+// expects to deserialize. mcs supplies the cryptographic operations (signing, verification,
+// identity validation) that both the comm layer's transport security and the gossip layer need;
+// in production this should be an api.MessageCryptoService backed by the local MSP (see
+// peer/gossip.NewMSPMessageCryptoService), rather than the naive impl below. secureConf controls
+// the TLS material used for both the gRPC server s should have been constructed with (via
+// secureConf.ServerCredentials()) and gossip's own outgoing dials to other peers; set
+// secureConf.InsecureGRPC for dev/demo use. mode selects the anti-entropy strategy (see
+// gossip.ReconciliationMode) the instance uses to reconcile its state with peers; operators tune
+// this per deployment, e.g. gossip.PushOnly for low-churn ordering service peers or
+// gossip.PushPull for organizations that add peers often.
+func NewGossipComponent(endpoint string, identity api.PeerIdentityType, s *grpc.Server, mcs CryptoService, secureConf *SecureConfig, mode gossip.ReconciliationMode, bootPeers ...string) service.GossipService {
+	conf := newConfig(endpoint, mode, bootPeers...)
+	commInstance := newComm(identity, s, mcs, secureConf)
+	gossipComponent := gossip.NewGossipService(conf, commInstance, mcs, mcs, identity)
+	startAntiEntropy(conf, identity, gossipComponent, mcs)
+	return service.NewGossipService(gossipComponent, commInstance)
+}
+
+// startAntiEntropy wires conf.ReconciliationMode into a running gossip.AntiEntropy loop: each
+// round it picks a handful of conf.BootstrapPeers and sends them this peer's own signed
+// membership entry. The push and the pull exchange both send that entry; the pull does not
+// request the remote peer's entries, so the modes differ only in pacing, fanout, and whether
+// the entry is sent once (PushOnly, PullOnly) or twice (PushPull) per peer per round.
+func startAntiEntropy(conf *gossip.Config, identity api.PeerIdentityType, gossipComponent gossip.Gossip, mcs CryptoService) {
+	selfAliveMsg := func() *proto.GossipMessage {
+		am := mcs.SignMessage(&proto.AliveMessage{
+			Identity: []byte(identity),
+			Membership: &proto.Membership{
+				PkiID:    []byte(mcs.GetPKIidOfCert(identity)),
+				Endpoint: conf.SelfEndpoint,
+			},
+		})
+		return &proto.GossipMessage{
+			Content: &proto.GossipMessage_AliveMsg{AliveMsg: am},
+		}
+	}
+
+	peerSelector := func(n int) []string {
+		peers := conf.BootstrapPeers
+		if len(peers) <= n {
+			return peers
+		}
+		shuffled := append([]string(nil), peers...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		return shuffled[:n]
+	}
+
+	gossip.NewAntiEntropy(conf, peerSelector,
+		func(peer string) { gossipComponent.Send(selfAliveMsg(), &comm.RemotePeer{Endpoint: peer}) },
+		func(peer string) { gossipComponent.Send(selfAliveMsg(), &comm.RemotePeer{Endpoint: peer}) },
+	)
 }
 
 // GossipCryptoService is an interface that conforms to both
@@ -80,17 +141,25 @@ type GossipCryptoService interface {
 	Sign(msg []byte) ([]byte, error)
 
 	// Verify checks that signature if a valid signature of message under vkID's verification key.
-	// If the verification succeeded, Verify returns nil meaning no error occurred.
-	// If vkID is nil, then the signature is verified against this validator's verification key.
-	Verify(vkID, signature, message []byte) error
+	// If the verification succeeded, Verify returns nil meaning no error occurred. If chainID is
+	// non-empty, vkID is resolved through that channel's MSP manager rather than the local MSP.
+	Verify(chainID common.ChainID, vkID api.PeerIdentityType, signature, message []byte) error
 
 	// validateAliveMsg validates that an Alive message is authentic
-	ValidateAliveMsg(*proto.AliveMessage) bool
+	ValidateAliveMsg(chainID common.ChainID, am *proto.AliveMessage) bool
 
 	// SignMessage signs an AliveMessage and updates its signature field
 	SignMessage(*proto.AliveMessage) *proto.AliveMessage
 }
 
+// CryptoService is the union of api.MessageCryptoService and GossipCryptoService that
+// NewGossipComponent requires: the former backs gossip's message-level crypto, the latter
+// backs alive-message signing/verification used by peer discovery.
+type CryptoService interface {
+	api.MessageCryptoService
+	GossipCryptoService
+}
+
 // NewGossipCryptoService returns an instance that implements naively every security
 // interface that the gossip layer needs
 func NewGossipCryptoService() GossipCryptoService {
@@ -100,11 +169,11 @@ func NewGossipCryptoService() GossipCryptoService {
 type naiveCryptoServiceImpl struct {
 }
 
-func (cs *naiveCryptoServiceImpl) ValidateAliveMsg(*proto.AliveMessage) bool {
+func (cs *naiveCryptoServiceImpl) ValidateAliveMsg(chainID common.ChainID, am *proto.AliveMessage) bool {
 	return true
 }
 
-func (cs *naiveCryptoServiceImpl) Verify(vkID, signature, message []byte) error {
+func (cs *naiveCryptoServiceImpl) Verify(chainID common.ChainID, vkID api.PeerIdentityType, signature, message []byte) error {
 	if ! bytes.Equal(signature, message) {
 		return fmt.Errorf("Wrong signature")
 	}
@@ -129,7 +198,7 @@ func (cs *naiveCryptoServiceImpl) Sign(msg []byte) ([]byte, error) {
 // Verify checks that signature is a valid signature of message under a peer's verification key.
 // If the verification succeeded, Verify returns nil meaning no error occurred.
 // If peerCert is nil, then the signature is verified against this peer's verification key.
-func (*naiveCryptoService) Verify(peerIdentity api.PeerIdentityType, signature, message []byte) error {
+func (*naiveCryptoService) Verify(chainID common.ChainID, peerIdentity api.PeerIdentityType, signature, message []byte) error {
 	equal := bytes.Equal(signature, message)
 	if !equal {
 		return fmt.Errorf("Wrong signature:%v, %v", signature, message)
@@ -137,10 +206,14 @@ func (*naiveCryptoService) Verify(peerIdentity api.PeerIdentityType, signature,
 	return nil
 }
 
+// naiveCryptoService is a CryptoService that short-circuits every check: Sign returns the
+// payload unchanged, Verify only compares bytes, and identity/alive-message validation always
+// succeeds. It exists for integration tests and demos ONLY; production code should use
+// peer/gossip.NewMSPMessageCryptoService instead.
 type naiveCryptoService struct {
 }
 
-func (*naiveCryptoService) ValidateAliveMsg(am *proto.AliveMessage) bool {
+func (*naiveCryptoService) ValidateAliveMsg(chainID common.ChainID, am *proto.AliveMessage) bool {
 	return true
 }
 
@@ -152,7 +225,7 @@ func (*naiveCryptoService) IsEnabled() bool {
 	return true
 }
 
-func (*naiveCryptoService) ValidateIdentity(peerIdentity api.PeerIdentityType) error {
+func (*naiveCryptoService) ValidateIdentity(chainID common.ChainID, peerIdentity api.PeerIdentityType) error {
 	return nil
 }
 
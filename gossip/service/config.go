@@ -0,0 +1,52 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+// Config describes the portion of a channel's configuration that gossip cares about: which
+// channel it pertains to, and which peers are reachable as anchor peers for bootstrapping
+// discovery with other organizations.
+type Config interface {
+	// ChainID returns the channel ID this configuration pertains to
+	ChainID() string
+
+	// AnchorPeerEndpoints returns the host:port addresses of the channel's current anchor peers
+	AnchorPeerEndpoints() []string
+}
+
+// ConfigProcessor is notified of channel configuration updates so that gossip can reconfigure
+// its view of anchor peers and endpoints without requiring a peer restart. A channel's config
+// manager obtains one via GossipService.NewConfigEventer and registers it as a listener.
+type ConfigProcessor interface {
+	// ProcessConfigUpdate is invoked whenever the channel's configuration changes
+	ProcessConfigUpdate(config Config)
+}
+
+// configEventer implements ConfigProcessor on top of a GossipService, updating the anchor peer
+// endpoints tracked for a channel whenever its configuration changes.
+type configEventer struct {
+	gossipSvc *gossipServiceImpl
+}
+
+func newConfigEventer(gossipSvc *gossipServiceImpl) *configEventer {
+	return &configEventer{gossipSvc: gossipSvc}
+}
+
+// ProcessConfigUpdate updates the anchor peer endpoints this peer gossips about config's
+// channel, so that newly-added peers are discoverable immediately.
+func (ce *configEventer) ProcessConfigUpdate(config Config) {
+	ce.gossipSvc.updateAnchorPeers(config.ChainID(), config.AnchorPeerEndpoints())
+}
@@ -0,0 +1,133 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hyperledger/fabric/core/committer"
+	"github.com/hyperledger/fabric/gossip/comm"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/gossip"
+	"github.com/hyperledger/fabric/gossip/proto"
+	"github.com/hyperledger/fabric/gossip/state"
+	pcommon "github.com/hyperledger/fabric/protos/common"
+)
+
+// GossipService is the peer-facing entry point into the gossip layer: it embeds the raw
+// gossip.Gossip transport and adds per-channel state replication against the ledger, so that
+// callers work in terms of channels and blocks rather than payloads and membership views.
+type GossipService interface {
+	gossip.Gossip
+
+	// NewConfigEventer returns a ConfigProcessor that the channel config manager can register to
+	// propagate channel configuration changes (e.g. anchor peer updates) to gossip.
+	NewConfigEventer() ConfigProcessor
+
+	// InitializeChannel allocates the state provider for chainID, seeded with the given anchor
+	// peer endpoints for bootstrapping discovery. It is a no-op if the channel was already
+	// initialized, and should be invoked once per channel per peer.
+	InitializeChannel(chainID string, committer committer.Committer, endpoints []string)
+
+	// GetBlock returns the block at index on chainID, or nil if chainID is unknown to this peer
+	// or the block hasn't been committed yet.
+	GetBlock(chainID string, index uint64) *pcommon.Block
+
+	// AddPayload hands payload to chainID's state provider for ordered commit. It returns an
+	// error if chainID has not been initialized via InitializeChannel.
+	AddPayload(chainID string, payload *proto.Payload) error
+}
+
+type gossipServiceImpl struct {
+	gossip.Gossip
+	comm comm.Comm
+
+	lock   sync.RWMutex
+	chains map[string]state.GossipStateProvider
+	// anchorPeers records the last anchor peer endpoints supplied per channel, by
+	// InitializeChannel or by a configuration update. Nothing in this package reads it back.
+	anchorPeers map[string][]string
+}
+
+// NewGossipService wraps gossipComponent and comm into a GossipService capable of driving
+// per-channel ledger state replication on top of the underlying gossip transport.
+func NewGossipService(gossipComponent gossip.Gossip, comm comm.Comm) GossipService {
+	return &gossipServiceImpl{
+		Gossip:      gossipComponent,
+		comm:        comm,
+		chains:      make(map[string]state.GossipStateProvider),
+		anchorPeers: make(map[string][]string),
+	}
+}
+
+// NewConfigEventer returns a ConfigProcessor bound to this service.
+func (g *gossipServiceImpl) NewConfigEventer() ConfigProcessor {
+	return newConfigEventer(g)
+}
+
+// InitializeChannel allocates a state provider for chainID, unless one already exists, and joins
+// the anchor peer endpoints so that the new state provider sees them as soon as it starts looking
+// for peers to reconcile with, rather than waiting for a later config update to resend them.
+func (g *gossipServiceImpl) InitializeChannel(chainID string, committer committer.Committer, endpoints []string) {
+	g.lock.Lock()
+	if _, exists := g.chains[chainID]; exists {
+		g.lock.Unlock()
+		return
+	}
+	g.chains[chainID] = state.NewGossipStateProvider(chainID, g, committer)
+	g.lock.Unlock()
+
+	g.updateAnchorPeers(chainID, endpoints)
+}
+
+// GetBlock delegates to chainID's state provider.
+func (g *gossipServiceImpl) GetBlock(chainID string, index uint64) *pcommon.Block {
+	g.lock.RLock()
+	provider, exists := g.chains[chainID]
+	g.lock.RUnlock()
+
+	if !exists {
+		return nil
+	}
+	return provider.GetBlock(index)
+}
+
+// AddPayload delegates to chainID's state provider.
+func (g *gossipServiceImpl) AddPayload(chainID string, payload *proto.Payload) error {
+	g.lock.RLock()
+	provider, exists := g.chains[chainID]
+	g.lock.RUnlock()
+
+	if !exists {
+		return fmt.Errorf("Channel %s has not been initialized", chainID)
+	}
+	return provider.AddPayload(payload)
+}
+
+// updateAnchorPeers records the channel's current anchor peer endpoints, and nudges gossip's
+// discovery layer to probe them so that they become reachable without waiting for a periodic
+// membership sync.
+func (g *gossipServiceImpl) updateAnchorPeers(chainID string, endpoints []string) {
+	g.lock.Lock()
+	g.anchorPeers[chainID] = endpoints
+	g.lock.Unlock()
+
+	for _, endpoint := range endpoints {
+		g.Gossip.JoinChan(common.ChainID(chainID), endpoint)
+	}
+}
@@ -0,0 +1,377 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/committer"
+	"github.com/hyperledger/fabric/gossip/comm"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/discovery"
+	"github.com/hyperledger/fabric/gossip/proto"
+	pcommon "github.com/hyperledger/fabric/protos/common"
+	"github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("gossip/state")
+
+// defaultAntiEntropyInterval is how often a provider checks whether it has fallen behind the
+// rest of the channel and pulls the blocks it is missing.
+const defaultAntiEntropyInterval = 10 * time.Second
+
+// GossipAdapter is the subset of the gossip layer that a GossipStateProvider needs: sending and
+// disseminating messages, and discovering channel membership. It is
+// satisfied by gossip/service.GossipService, and kept narrow so that gossip/state does not import
+// gossip/service back (which would cycle, since gossip/service imports gossip/state).
+type GossipAdapter interface {
+	// Send sends msg directly to the given peers
+	Send(msg *proto.GossipMessage, peers ...*comm.RemotePeer)
+
+	// Gossip disseminates msg across the channel via gossip's push/pull machinery
+	Gossip(msg *proto.GossipMessage)
+
+	// Accept returns a channel of messages received from other peers that satisfy acceptor
+	Accept(acceptor common.MessageAcceptor, passThrough bool) (<-chan *proto.GossipMessage, <-chan proto.ReceivedMessage)
+
+	// PeersOfChannel returns the known members of chainID
+	PeersOfChannel(chainID common.ChainID) []discovery.NetworkMember
+}
+
+// GossipStateProvider keeps a channel's ledger in sync with its peers: it accepts payloads
+// pushed over gossip, pulls whatever blocks are missing from other members of the channel, and
+// commits blocks to the ledger, in order, through a committer.Committer.
+type GossipStateProvider interface {
+	// AddPayload queues payload for commit once every preceding sequence number has arrived, and
+	// disseminates it to the rest of the channel via gossip.
+	AddPayload(payload *proto.Payload) error
+
+	// GetBlock returns the committed block at the given sequence number, or nil if it hasn't
+	// been committed yet.
+	GetBlock(index uint64) *pcommon.Block
+
+	// Stop releases the goroutines and resources owned by the provider.
+	Stop()
+}
+
+type gossipStateProviderImpl struct {
+	chainID string
+
+	mediator GossipAdapter
+
+	committer committer.Committer
+
+	mutex sync.RWMutex
+	// payloads holds blocks that have arrived out of order, keyed by sequence number, until the
+	// gap below them is filled and they can be committed.
+	payloads map[uint64]*proto.Payload
+
+	// payloadsCh delivers data messages and state responses accepted off the channel, for
+	// commitLoop to buffer via addPayload.
+	payloadsCh <-chan *proto.GossipMessage
+	// stateRequestCh delivers state requests accepted off the channel, for serveStateRequests to
+	// answer out of this peer's committed ledger.
+	stateRequestCh <-chan proto.ReceivedMessage
+
+	stopCh chan struct{}
+	once   sync.Once
+}
+
+// NewGossipStateProvider creates a state provider for chainID. It immediately starts a
+// background loop that buffers and commits payloads delivered over gossip as soon as they become
+// contiguous with the ledger height, a loop that serves state requests from peers that have
+// fallen behind out of this peer's committed ledger, and a periodic anti-entropy loop that pulls
+// blocks from mediator when this peer has fallen behind.
+func NewGossipStateProvider(chainID string, mediator GossipAdapter, committer committer.Committer) GossipStateProvider {
+	payloadsCh, _ := mediator.Accept(stateMessageAcceptor(chainID, isDataOrStateResponseMsg), false)
+	_, stateRequestCh := mediator.Accept(stateMessageAcceptor(chainID, isStateRequestMsg), true)
+
+	s := &gossipStateProviderImpl{
+		chainID:        chainID,
+		mediator:       mediator,
+		committer:      committer,
+		payloads:       make(map[uint64]*proto.Payload),
+		payloadsCh:     payloadsCh,
+		stateRequestCh: stateRequestCh,
+		stopCh:         make(chan struct{}),
+	}
+
+	go s.commitLoop()
+	go s.serveStateRequests()
+	go s.antiEntropy()
+
+	return s
+}
+
+// AddPayload buffers payload, triggers an immediate attempt to commit it (and any payloads it
+// unblocks), and disseminates it to the rest of the channel via gossip.
+func (s *gossipStateProviderImpl) AddPayload(payload *proto.Payload) error {
+	if payload == nil {
+		return nil
+	}
+	s.addPayload(payload)
+
+	s.mediator.Gossip(&proto.GossipMessage{
+		Channel: []byte(s.chainID),
+		Content: &proto.GossipMessage_DataMsg{
+			DataMsg: &proto.DataMessage{Payload: payload},
+		},
+	})
+	return nil
+}
+
+// addPayload buffers payload and attempts to commit it, without re-disseminating it. It is the
+// path used for payloads that arrived over gossip in the first place, so that commitLoop doesn't
+// re-gossip every message it receives right back out. A payload whose sequence number is below
+// the current ledger height is dropped rather than buffered, since it can never become the gap-filling entry
+// tryCommit is waiting for and would otherwise sit in s.payloads forever.
+func (s *gossipStateProviderImpl) addPayload(payload *proto.Payload) {
+	if height, err := s.committer.LedgerHeight(); err == nil && payload.SeqNum < height {
+		return
+	}
+
+	s.mutex.Lock()
+	s.payloads[payload.SeqNum] = payload
+	s.mutex.Unlock()
+
+	s.tryCommit()
+}
+
+// GetBlock returns the block at index if this peer has committed it, else nil.
+func (s *gossipStateProviderImpl) GetBlock(index uint64) *pcommon.Block {
+	block, err := s.committer.GetBlockByNumber(index)
+	if err != nil {
+		return nil
+	}
+	return block
+}
+
+// Stop terminates the commit, state-serving and anti-entropy loops.
+func (s *gossipStateProviderImpl) Stop() {
+	s.once.Do(func() {
+		close(s.stopCh)
+	})
+}
+
+// commitLoop buffers every data message and state response this peer receives over gossip for
+// chainID, via addPayload, so that tryCommit gets a chance to drain the backlog as soon as a
+// gap-filling block arrives, however it arrived.
+func (s *gossipStateProviderImpl) commitLoop() {
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case msg, ok := <-s.payloadsCh:
+			if !ok {
+				return
+			}
+			s.handleGossipMessage(msg)
+		}
+	}
+}
+
+func (s *gossipStateProviderImpl) handleGossipMessage(msg *proto.GossipMessage) {
+	switch content := msg.Content.(type) {
+	case *proto.GossipMessage_DataMsg:
+		s.addPayload(content.DataMsg.Payload)
+	case *proto.GossipMessage_StateResponse:
+		for _, payload := range content.StateResponse.Payloads {
+			s.addPayload(payload)
+		}
+	}
+}
+
+// serveStateRequests answers state requests from peers that have fallen behind, pulling the
+// blocks they are missing out of this peer's already-committed ledger.
+func (s *gossipStateProviderImpl) serveStateRequests() {
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case msg, ok := <-s.stateRequestCh:
+			if !ok {
+				return
+			}
+			s.handleStateRequest(msg)
+		}
+	}
+}
+
+func (s *gossipStateProviderImpl) handleStateRequest(msg proto.ReceivedMessage) {
+	request := msg.GetGossipMessage().GetStateRequest()
+	if request == nil {
+		return
+	}
+
+	height, err := s.committer.LedgerHeight()
+	if err != nil {
+		logger.Errorf("Failed obtaining ledger height for channel %s, cannot answer state request: %s", s.chainID, err)
+		return
+	}
+
+	var payloads []*proto.Payload
+	for seqNum := request.StartSeqNum; seqNum < height; seqNum++ {
+		block, err := s.committer.GetBlockByNumber(seqNum)
+		if err != nil {
+			logger.Warningf("Failed fetching block %d for channel %s to answer a state request: %s", seqNum, s.chainID, err)
+			continue
+		}
+		data, err := block.Marshal()
+		if err != nil {
+			logger.Warningf("Failed marshaling block %d for channel %s to answer a state request: %s", seqNum, s.chainID, err)
+			continue
+		}
+		payloads = append(payloads, &proto.Payload{SeqNum: seqNum, Data: data})
+	}
+
+	msg.Respond(&proto.GossipMessage{
+		Channel: []byte(s.chainID),
+		Content: &proto.GossipMessage_StateResponse{
+			StateResponse: &proto.StateResponse{Payloads: payloads},
+		},
+	})
+}
+
+// tryCommit drains consecutive buffered payloads starting at the current ledger height and
+// commits each of them, in order, through the committer. A payload stays buffered, and commit
+// retrying stops, the moment one fails to decode or commit, so that a single malformed payload or
+// a transient commit failure doesn't silently lose the block.
+func (s *gossipStateProviderImpl) tryCommit() {
+	for {
+		height, err := s.committer.LedgerHeight()
+		if err != nil {
+			logger.Errorf("Failed obtaining ledger height for channel %s, stopping commit: %s", s.chainID, err)
+			return
+		}
+
+		s.mutex.RLock()
+		payload, ok := s.payloads[height]
+		s.mutex.RUnlock()
+		if !ok {
+			return
+		}
+
+		block, err := payloadToBlock(payload)
+		if err != nil {
+			logger.Errorf("Failed unmarshaling buffered block at sequence %d for channel %s, leaving it buffered: %s", height, s.chainID, err)
+			return
+		}
+
+		if err := s.committer.Commit(block); err != nil {
+			logger.Errorf("Failed committing block at sequence %d for channel %s, leaving it buffered for retry: %s", height, s.chainID, err)
+			return
+		}
+
+		s.mutex.Lock()
+		delete(s.payloads, height)
+		s.mutex.Unlock()
+	}
+}
+
+// antiEntropy periodically checks whether peers on the channel are ahead of this one and, if so,
+// requests the missing blocks so that a lagging or newly-joined peer catches up even if the
+// payloads that would have filled the gap were missed over gossip.
+func (s *gossipStateProviderImpl) antiEntropy() {
+	ticker := time.NewTicker(defaultAntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.requestMissingBlocks()
+		}
+	}
+}
+
+// requestMissingBlocks compares this peer's ledger height against its channel peers' advertised
+// heights and, if it is behind, sends a state request for the blocks it is missing to a random
+// peer that is actually ahead of it.
+func (s *gossipStateProviderImpl) requestMissingBlocks() {
+	height, err := s.committer.LedgerHeight()
+	if err != nil {
+		return
+	}
+
+	var ahead []discovery.NetworkMember
+	for _, peer := range s.mediator.PeersOfChannel(common.ChainID(s.chainID)) {
+		peerHeight, ok := decodeLedgerHeight(peer.Metadata)
+		if !ok || peerHeight <= height {
+			continue
+		}
+		ahead = append(ahead, peer)
+	}
+	if len(ahead) == 0 {
+		return
+	}
+
+	peer := ahead[rand.Intn(len(ahead))]
+	s.mediator.Send(&proto.GossipMessage{
+		Channel: []byte(s.chainID),
+		Content: &proto.GossipMessage_StateRequest{
+			StateRequest: &proto.StateRequest{StartSeqNum: height},
+		},
+	}, &comm.RemotePeer{Endpoint: peer.Endpoint, PKIID: peer.PKIid})
+}
+
+// decodeLedgerHeight decodes the ledger height a peer advertises in its channel metadata, encoded
+// as a big-endian uint64.
+func decodeLedgerHeight(metadata []byte) (uint64, bool) {
+	if len(metadata) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(metadata), true
+}
+
+// payloadToBlock unmarshals the raw block bytes carried by a gossip payload.
+func payloadToBlock(payload *proto.Payload) (*pcommon.Block, error) {
+	block := &pcommon.Block{}
+	if err := block.Unmarshal(payload.Data); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// stateMessageAcceptor adapts a predicate over *proto.GossipMessage into a common.MessageAcceptor
+// scoped to chainID, for use with GossipAdapter.Accept.
+func stateMessageAcceptor(chainID string, match func(*proto.GossipMessage) bool) common.MessageAcceptor {
+	return func(message interface{}) bool {
+		msg, isGossipMsg := message.(*proto.GossipMessage)
+		if !isGossipMsg || string(msg.Channel) != chainID {
+			return false
+		}
+		return match(msg)
+	}
+}
+
+func isDataOrStateResponseMsg(msg *proto.GossipMessage) bool {
+	switch msg.Content.(type) {
+	case *proto.GossipMessage_DataMsg, *proto.GossipMessage_StateResponse:
+		return true
+	default:
+		return false
+	}
+}
+
+func isStateRequestMsg(msg *proto.GossipMessage) bool {
+	_, isStateRequest := msg.Content.(*proto.GossipMessage_StateRequest)
+	return isStateRequest
+}
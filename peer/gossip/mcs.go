@@ -0,0 +1,175 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gossip
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/integration"
+	"github.com/hyperledger/fabric/gossip/proto"
+	"github.com/hyperledger/fabric/msp"
+)
+
+// mspMessageCryptoService implements gossip/integration.CryptoService (which in turn embeds
+// api.MessageCryptoService) on top of the peer's local MSP, so that gossip can be driven by the
+// same identities and signatures the rest of the peer already trusts, instead of the naive
+// byte-equality checks used for demos.
+type mspMessageCryptoService struct {
+	localMSP        msp.MSP
+	deserializerMgr msp.DeserializerManager
+}
+
+// NewMSPMessageCryptoService creates a gossip CryptoService backed by the peer's local MSP.
+// localMSP is used to sign outgoing messages with the peer's own identity; deserializerMgr is
+// used to resolve a remote peer's serialized identity into a verifying msp.Identity, scoped to
+// the channel the message pertains to.
+func NewMSPMessageCryptoService(localMSP msp.MSP, deserializerMgr msp.DeserializerManager) integration.CryptoService {
+	return &mspMessageCryptoService{localMSP: localMSP, deserializerMgr: deserializerMgr}
+}
+
+// GetPKIidOfCert returns the PKI-ID of a peer's identity, which for the MSP implementation is
+// the SHA-256 digest of its serialized identity bytes.
+func (s *mspMessageCryptoService) GetPKIidOfCert(peerIdentity api.PeerIdentityType) common.PKIidType {
+	if len(peerIdentity) == 0 {
+		return nil
+	}
+	digest := sha256.Sum256(peerIdentity)
+	return common.PKIidType(digest[:])
+}
+
+// VerifyBlock returns nil if the block's LastConfigSeq is not older than the channel's current
+// ConfigSeq and every metadata signature on it verifies under its signer's identity as
+// deserialized by the channel's MSP manager, else returns an error. It does not check which
+// organization or role the signers belong to, and a block with no metadata signatures passes.
+func (s *mspMessageCryptoService) VerifyBlock(signedBlock api.SignedBlock) error {
+	block := signedBlock.Block()
+	if block == nil || block.Header == nil || block.Metadata == nil {
+		return fmt.Errorf("Cannot verify an incomplete block")
+	}
+	chainID, err := signedBlock.ChainID()
+	if err != nil {
+		return fmt.Errorf("Failed extracting channel ID from block: %s", err)
+	}
+	mspMgr := msp.GetManagerForChain(chainID)
+	if mspMgr == nil {
+		return fmt.Errorf("Could not acquire MSP manager for channel %s", chainID)
+	}
+	if signedBlock.LastConfigSeq() < signedBlock.ConfigSeq() {
+		return fmt.Errorf("Block %d was signed against a stale channel configuration (seq %d < %d)",
+			block.Header.Number, signedBlock.LastConfigSeq(), signedBlock.ConfigSeq())
+	}
+	for _, metadataSignature := range block.Metadata.Signatures {
+		identity, err := mspMgr.DeserializeIdentity(metadataSignature.SignerIdentity)
+		if err != nil {
+			return fmt.Errorf("Failed deserializing block metadata signer: %s", err)
+		}
+		if err := identity.Verify(append(block.Metadata.Value, metadataSignature.Nonce...), metadataSignature.Signature); err != nil {
+			return fmt.Errorf("Failed verifying block metadata signature: %s", err)
+		}
+	}
+	return nil
+}
+
+// Sign signs msg with the local peer's signing identity as obtained from the local MSP.
+func (s *mspMessageCryptoService) Sign(msg []byte) ([]byte, error) {
+	identity, err := s.localMSP.GetDefaultSigningIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("Failed obtaining the default signing identity: %s", err)
+	}
+	return identity.Sign(msg)
+}
+
+// Verify checks that signature is a valid signature of message under peerIdentity's verification
+// key. When chainID is non-empty, peerIdentity is resolved through that channel's MSP manager, so
+// a cross-org peer is checked against the trust roots the channel config actually admits rather
+// than this peer's own local MSP; chainID may be empty when no channel context is available.
+func (s *mspMessageCryptoService) Verify(chainID common.ChainID, peerIdentity api.PeerIdentityType, signature, message []byte) error {
+	identity, err := s.deserialize(peerIdentity, string(chainID))
+	if err != nil {
+		return fmt.Errorf("Failed deserializing identity: %s", err)
+	}
+	return identity.Verify(message, signature)
+}
+
+// ValidateIdentity validates a remote peer's identity by deserializing it through chainID's MSP
+// manager when chainID is non-empty, or the local MSP otherwise; an identity that is malformed,
+// revoked or expired yields an error.
+func (s *mspMessageCryptoService) ValidateIdentity(chainID common.ChainID, peerIdentity api.PeerIdentityType) error {
+	_, err := s.deserialize(peerIdentity, string(chainID))
+	return err
+}
+
+// ValidateAliveMsg validates that an Alive message is authentic, by verifying its signature
+// against the identity carried in the message, resolved through chainID's MSP manager when
+// chainID is non-empty. The signature covers the whole Membership payload (PkiID, Endpoint,
+// Metadata and timestamp), not just the PkiID, so that a relaying peer can't rewrite a member's
+// endpoint or metadata while keeping its original, still-valid signature.
+func (s *mspMessageCryptoService) ValidateAliveMsg(chainID common.ChainID, am *proto.AliveMessage) bool {
+	if am == nil || am.Membership == nil {
+		return false
+	}
+	identity, err := s.deserialize(api.PeerIdentityType(am.Identity), string(chainID))
+	if err != nil {
+		return false
+	}
+	membership, err := am.Membership.Marshal()
+	if err != nil {
+		return false
+	}
+	return identity.Verify(membership, am.Signature) == nil
+}
+
+// SignMessage signs an AliveMessage with the local peer's signing identity and updates its
+// signature field. It signs the whole Membership payload, not just the PkiID, so that Endpoint,
+// Metadata and timestamp are covered by the signature as well.
+func (s *mspMessageCryptoService) SignMessage(am *proto.AliveMessage) *proto.AliveMessage {
+	identity, err := s.localMSP.GetDefaultSigningIdentity()
+	if err != nil {
+		return am
+	}
+	membership, err := am.Membership.Marshal()
+	if err != nil {
+		return am
+	}
+	sig, err := identity.Sign(membership)
+	if err != nil {
+		return am
+	}
+	am.Signature = sig
+	return am
+}
+
+// IsEnabled always returns true: the MSP-backed implementation never falls back to naive checks.
+func (s *mspMessageCryptoService) IsEnabled() bool {
+	return true
+}
+
+// deserialize resolves a serialized peer identity into an msp.Identity, using the channel's MSP
+// manager when chainID is non-empty, or the local MSP otherwise.
+func (s *mspMessageCryptoService) deserialize(peerIdentity api.PeerIdentityType, chainID string) (msp.Identity, error) {
+	if chainID == "" {
+		return s.localMSP.DeserializeIdentity(peerIdentity)
+	}
+	mspMgr := msp.GetManagerForChain(chainID)
+	if mspMgr == nil {
+		return nil, fmt.Errorf("Could not acquire MSP manager for channel %s", chainID)
+	}
+	return s.deserializerMgr.GetDeserializer(chainID, mspMgr).DeserializeIdentity(peerIdentity)
+}